@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Uninstall removes every chained conflist this installer owns in confDir.
+// Every conflist this installer writes lives under the deterministic
+// "05-cilium-chain-" naming scheme (see chainedConfPath) and is a synthetic
+// side file that never existed before install - the upstream conflist it
+// was chained from is never modified or renamed - so uninstalling is just
+// deleting our own output, not restoring anything.
+func Uninstall(confDir string) error {
+	entries, err := os.ReadDir(confDir)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(confDir, entry.Name())
+		owned, err := isOwnedCNIConf(path)
+		if err != nil || !owned {
+			continue
+		}
+
+		if err := removeOwnedCNIConf(path); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", path, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("error uninstalling CNI configuration(s): %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallUninstallRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+
+	original := []byte(`{
+  "cniVersion": "0.3.1",
+  "name": "calico",
+  "plugins": [
+    {
+      "type": "calico"
+    }
+  ]
+}
+`)
+	originalPath := filepath.Join(tempDir, "05-calico.conflist")
+	require.NoError(t, os.WriteFile(originalPath, original, 0o644))
+
+	cniConfChain := []byte(`{"cniVersion": "0.3.1", "name": "cilium-cni", "type": "cilium-cni"}`)
+
+	w := &cniWatcher{
+		confDir:      tempDir,
+		chainMode:    "generic-veth",
+		cniConfChain: cniConfChain,
+	}
+	require.NoError(t, w.resync())
+
+	chainedPath, err := chainedConfPath(tempDir, "calico")
+	require.NoError(t, err)
+	chained, err := os.ReadFile(chainedPath)
+	require.NoError(t, err)
+	require.Contains(t, string(chained), "cilium-cni")
+
+	untouched, err := os.ReadFile(originalPath)
+	require.NoError(t, err)
+	require.JSONEq(t, string(original), string(untouched))
+
+	require.NoError(t, Uninstall(tempDir))
+
+	_, err = os.Stat(chainedPath)
+	require.True(t, os.IsNotExist(err))
+
+	untouched, err = os.ReadFile(originalPath)
+	require.NoError(t, err)
+	require.JSONEq(t, string(original), string(untouched))
+}
+
+func TestUninstallDeletesMultiTargetChainedConf(t *testing.T) {
+	tempDir := t.TempDir()
+
+	original := []byte(`{
+  "cniVersion": "0.3.1",
+  "name": "calico",
+  "plugins": [
+    {
+      "type": "calico"
+    }
+  ]
+}
+`)
+	originalPath := filepath.Join(tempDir, "05-calico.conflist")
+	require.NoError(t, os.WriteFile(originalPath, original, 0o644))
+
+	cniConfChain := []byte(`{"cniVersion": "0.3.1", "name": "cilium-cni", "type": "cilium-cni"}`)
+
+	w := &cniWatcher{
+		confDir:      tempDir,
+		chainMode:    "generic-veth",
+		cniConfChain: cniConfChain,
+		chainTargets: []string{"calico"},
+	}
+	require.NoError(t, w.resyncTargets())
+
+	chainedPath, err := chainedConfPath(tempDir, "calico")
+	require.NoError(t, err)
+	_, err = os.Stat(chainedPath)
+	require.NoError(t, err)
+
+	require.NoError(t, Uninstall(tempDir))
+
+	_, err = os.Stat(chainedPath)
+	require.True(t, os.IsNotExist(err))
+
+	untouched, err := os.ReadFile(originalPath)
+	require.NoError(t, err)
+	require.JSONEq(t, string(original), string(untouched))
+}
@@ -11,8 +11,13 @@ import (
 	"strings"
 
 	"github.com/containernetworking/cni/libcni"
+	cniversion "github.com/containernetworking/cni/pkg/version"
 )
 
+// defaultCNIVersion is the cniVersion assumed for an original or inserted
+// config that declares none; each config falls back to it independently.
+const defaultCNIVersion = "0.3.1"
+
 // Get the default CNI configuration under some directory
 func getDefaultCNINetworkList(confDir string) (string, []byte, error) {
 	files, err := libcni.ConfFiles(confDir, []string{".conf", ".conflist"})
@@ -25,6 +30,14 @@ func getDefaultCNINetworkList(confDir string) (string, []byte, error) {
 
 	sort.Strings(files)
 	for _, confFile := range files {
+		// Skip conflists this installer wrote itself; the chained output
+		// sorts ahead of typical upstream filenames precisely so CNI picks
+		// it up, but that means it must never be mistaken for a new
+		// upstream primary to chain into.
+		if owned, err := isOwnedCNIConf(confFile); err == nil && owned {
+			continue
+		}
+
 		confList, err := getCNINetworkListFromFile(confFile)
 		if err != nil {
 			continue
@@ -35,10 +48,69 @@ func getDefaultCNINetworkList(confDir string) (string, []byte, error) {
 	return "", nil, fmt.Errorf("no valid networks found in %s", confDir)
 }
 
+// cniConfigName returns the declared "name" of a raw CNI config list.
+func cniConfigName(confList []byte) (string, error) {
+	var confMap map[string]interface{}
+	if err := json.Unmarshal(confList, &confMap); err != nil {
+		return "", err
+	}
+	name, _ := confMap["name"].(string)
+	return name, nil
+}
+
+// discoverCNINetworkLists walks confDir and indexes every valid CNI conf or
+// conflist by its declared network name. This backs chaining against
+// multiple named upstream networks (e.g. calico plus a secondary macvlan),
+// as opposed to getDefaultCNINetworkList which only considers the single
+// lexicographically-first one.
+func discoverCNINetworkLists(confDir string) (map[string]*libcni.NetworkConfigList, error) {
+	files, err := libcni.ConfFiles(confDir, []string{".conf", ".conflist"})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	networks := make(map[string]*libcni.NetworkConfigList, len(files))
+	for _, confFile := range files {
+		// Skip conflists this installer wrote itself, the same way
+		// getDefaultCNINetworkList does: it must never be indexed as an
+		// upstream network to chain into, even if its declared name
+		// happened to collide with a real target's.
+		if owned, err := isOwnedCNIConf(confFile); err == nil && owned {
+			continue
+		}
+
+		confList, err := getCNINetworkListObjectFromFile(confFile)
+		if err != nil {
+			continue
+		}
+
+		// Earlier (lexicographically lower) files win on name collisions,
+		// consistent with how getDefaultCNINetworkList picks a primary.
+		if _, ok := networks[confList.Name]; ok {
+			continue
+		}
+		networks[confList.Name] = confList
+	}
+
+	return networks, nil
+}
+
 // Get the CNI network list from the file.
 // If the file is suffixed with .conflist, read the contents directly
 // If the file is suffixed with .conf, convert the Conf to ConfList
 func getCNINetworkListFromFile(name string) ([]byte, error) {
+	confList, err := getCNINetworkListObjectFromFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return confList.Bytes, nil
+}
+
+// getCNINetworkListObjectFromFile is like getCNINetworkListFromFile but
+// returns the parsed *libcni.NetworkConfigList, e.g. so callers can inspect
+// its declared Name.
+func getCNINetworkListObjectFromFile(name string) (*libcni.NetworkConfigList, error) {
 	var confList *libcni.NetworkConfigList
 	var err error
 	if strings.HasSuffix(name, ".conflist") {
@@ -68,10 +140,10 @@ func getCNINetworkListFromFile(name string) ([]byte, error) {
 	}
 	if len(confList.Plugins) == 0 {
 		log.Warnf("CNI config list %s has no networks, skipping", confList.Name)
-		return nil, err
+		return nil, fmt.Errorf("CNI config list %s has no networks", confList.Name)
 	}
 
-	return confList.Bytes, nil
+	return confList, nil
 }
 
 // Append the new CNI configuration into the original CNI configuration
@@ -91,15 +163,11 @@ func insertConfList(cniChainMode string, original []byte, inserted []byte) ([]by
 	newMap := make(map[string]interface{}, 0)
 	newMap["name"] = cniChainMode
 
-	if insertedCniVersion, ok := insertedMap["cniVersion"]; ok {
-		newMap["cniVersion"] = insertedCniVersion
-	} else {
-		if existingCniVersion, ok := originalMap["cniVersion"]; ok {
-			newMap["cniVersion"] = existingCniVersion
-		} else {
-			newMap["cniVersion"] = "0.3.1"
-		}
+	cniVersion, err := negotiateCNIVersion(original, inserted)
+	if err != nil {
+		return nil, err
 	}
+	newMap["cniVersion"] = cniVersion
 
 	delete(insertedMap, "cniVersion")
 	delete(originalMap, "cniVersion")
@@ -137,6 +205,89 @@ func insertConfList(cniChainMode string, original []byte, inserted []byte) ([]by
 	return marshalCNIConfig(newMap)
 }
 
+// cniVersionIncompatibleError is returned when the inserted and original
+// CNI configs declare spec versions that this library has no mutually
+// supported version for.
+type cniVersionIncompatibleError struct {
+	original string
+	inserted string
+}
+
+func (e *cniVersionIncompatibleError) Error() string {
+	return fmt.Sprintf("incompatible CNI spec versions: original config uses %q, inserted config uses %q, "+
+		"and this version of cilium-cni supports up to %q", e.original, e.inserted, cniversion.Current())
+}
+
+// negotiateCNIVersion determines the cniVersion the chained conflist should
+// declare, given the raw original and inserted CNI configs. It compares only
+// the two configs' declared cniVersion fields (falling back to
+// defaultCNIVersion where absent) and picks the higher of the two, since the
+// inserted (Cilium) plugin may require CHECK/GC semantics the original
+// config's version predates.
+//
+// This is a deliberately narrower negotiation than "intersection of the
+// inserted and original plugin supported-version ranges" via
+// version.PluginSupports probes: this installer only ever reads and rewrites
+// conf files in confDir, it has no plugin binary paths and never execs
+// anything, so there is no plugin to probe. Consulting a declared
+// cniVersions-range array would be feasible without exec'ing a binary, but
+// no upstream CNI plugin this installer chains into today emits one, so
+// there's nothing to read yet either. A plugin that only declares a single
+// cniVersion is trusted to support it, even if its binary doesn't actually
+// implement every verb that version implies. If a real need for
+// range-aware negotiation shows up (a plugin that only advertises a
+// supported-version range), this function is the place to add it.
+//
+// If the higher version is newer than what this library understands, it
+// returns a structured error instead of emitting a conflist we can't
+// validate.
+func negotiateCNIVersion(original, inserted []byte) (string, error) {
+	originalVersion, err := decodeCNIVersion(original)
+	if err != nil {
+		return "", fmt.Errorf("error determining cniVersion of existing CNI config: %v", err)
+	}
+
+	insertedVersion, err := decodeCNIVersion(inserted)
+	if err != nil {
+		return "", fmt.Errorf("error determining cniVersion of inserted CNI config: %v", err)
+	}
+
+	higher, err := cniversion.GreaterThanOrEqualTo(insertedVersion, originalVersion)
+	if err != nil {
+		return "", fmt.Errorf("error comparing CNI spec versions %q and %q: %v", insertedVersion, originalVersion, err)
+	}
+
+	negotiated := originalVersion
+	if higher {
+		negotiated = insertedVersion
+	}
+
+	supported, err := cniversion.GreaterThanOrEqualTo(cniversion.Current(), negotiated)
+	if err != nil {
+		return "", fmt.Errorf("error comparing CNI spec version %q against current %q: %v", negotiated, cniversion.Current(), err)
+	}
+	if !supported {
+		return "", &cniVersionIncompatibleError{original: originalVersion, inserted: insertedVersion}
+	}
+
+	return negotiated, nil
+}
+
+// decodeCNIVersion returns the effective cniVersion of a raw CNI config or
+// config list, falling back to defaultCNIVersion if the config declares no
+// version at all.
+func decodeCNIVersion(raw []byte) (string, error) {
+	decoder := cniversion.ConfigDecoder{}
+	cniVersion, err := decoder.Decode(raw)
+	if err != nil {
+		return "", err
+	}
+	if cniVersion == "" {
+		return defaultCNIVersion, nil
+	}
+	return cniVersion, nil
+}
+
 // Get the plugins form CNI config map
 func getPluginsFromCNIConfigMap(cniConfigMap map[string]interface{}) ([]interface{}, error) {
 	var plugins []interface{}
@@ -262,6 +262,127 @@ func TestInsertConfList(t *testing.T) {
 	}
 }
 
+func TestNegotiateCNIVersion(t *testing.T) {
+	cases := []struct {
+		name            string
+		original        string
+		inserted        string
+		expected        string
+		expectedFailure bool
+	}{
+		{
+			name:     "both 0.3.1",
+			original: `{"cniVersion": "0.3.1"}`,
+			inserted: `{"cniVersion": "0.3.1"}`,
+			expected: "0.3.1",
+		},
+		{
+			name:     "inserted newer than original",
+			original: `{"cniVersion": "0.2.0"}`,
+			inserted: `{"cniVersion": "0.3.0"}`,
+			expected: "0.3.0",
+		},
+		{
+			name:     "original newer than inserted",
+			original: `{"cniVersion": "0.4.0"}`,
+			inserted: `{"cniVersion": "0.3.1"}`,
+			expected: "0.4.0",
+		},
+		{
+			name:     "both 1.0.0",
+			original: `{"cniVersion": "1.0.0"}`,
+			inserted: `{"cniVersion": "1.0.0"}`,
+			expected: "1.0.0",
+		},
+		{
+			name:     "0.3.0 original, 0.3.1 inserted",
+			original: `{"cniVersion": "0.3.0"}`,
+			inserted: `{"cniVersion": "0.3.1"}`,
+			expected: "0.3.1",
+		},
+		{
+			name:     "0.3.1 original, 0.4.0 inserted",
+			original: `{"cniVersion": "0.3.1"}`,
+			inserted: `{"cniVersion": "0.4.0"}`,
+			expected: "0.4.0",
+		},
+		{
+			name:     "0.4.0 original, 1.0.0 inserted",
+			original: `{"cniVersion": "0.4.0"}`,
+			inserted: `{"cniVersion": "1.0.0"}`,
+			expected: "1.0.0",
+		},
+		{
+			name:     "0.2.0 original, 0.2.0 inserted",
+			original: `{"cniVersion": "0.2.0"}`,
+			inserted: `{"cniVersion": "0.2.0"}`,
+			expected: "0.2.0",
+		},
+		{
+			name:     "neither declares a version",
+			original: `{}`,
+			inserted: `{}`,
+			expected: defaultCNIVersion,
+		},
+		{
+			name:            "inserted declares an unsupported future version",
+			original:        `{"cniVersion": "0.3.1"}`,
+			inserted:        `{"cniVersion": "100.0.0"}`,
+			expectedFailure: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := negotiateCNIVersion([]byte(c.original), []byte(c.inserted))
+			if (c.expectedFailure && err == nil) || (!c.expectedFailure && err != nil) {
+				t.Fatalf("expected failure: %t, got %v", c.expectedFailure, err)
+			}
+
+			if c.expected != "" {
+				require.Equal(t, c.expected, result)
+			}
+		})
+	}
+}
+
+func TestDiscoverCNINetworkLists(t *testing.T) {
+	tempDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "05-calico.conflist"), []byte(`
+{
+	"cniVersion": "0.3.1",
+	"name": "calico",
+	"plugins": [{"type": "calico"}]
+}`), 0o644))
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "10-macvlan.conf"), []byte(`
+{
+	"cniVersion": "0.3.1",
+	"name": "macvlan-net",
+	"type": "macvlan"
+}`), 0o644))
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "20-broken.conf"), []byte(`not json`), 0o644))
+
+	owned, err := markCNIConfAsOwned([]byte(`{"name": "calico", "plugins": []}`))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "05-cilium-chain-calico.conflist"), owned, 0o644))
+
+	networks, err := discoverCNINetworkLists(tempDir)
+	require.NoError(t, err)
+	require.Len(t, networks, 2)
+	require.Contains(t, networks, "calico")
+	require.Contains(t, networks, "macvlan-net")
+
+	// The chained output this installer wrote itself must never be
+	// indexed as an upstream network, even though it happens to declare
+	// the same name as the real upstream "calico" network above: the
+	// indexed entry should still be the real upstream file, not the owned
+	// one.
+	require.NotContains(t, string(networks["calico"].Bytes), cniChainOwnerKey)
+}
+
 func TestGetCNINetworkListFromFile(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -0,0 +1,415 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// cniChainOwnerKey is the key embedded into every chained conflist this
+	// installer writes out. It lets the watcher tell its own output apart
+	// from conflists an operator authored or edited by hand across restarts.
+	cniChainOwnerKey = "cni-chain-owner"
+
+	// cniChainOwnerValue is the marker value stored under cniChainOwnerKey.
+	cniChainOwnerValue = "cilium"
+
+	// cniWatchDebounce bounds how often a burst of fs events triggers a
+	// re-chain; CNI conf directories commonly see several writes in quick
+	// succession (atomic renames, kubelet re-reads, etc).
+	cniWatchDebounce = 1 * time.Second
+)
+
+// cniWatcher watches confDir for changes and keeps the chained conflist(s)
+// in sync with whatever the current "primary" upstream CNI config is.
+type cniWatcher struct {
+	confDir      string
+	chainMode    string
+	cniConfChain []byte
+
+	// chainTargets, when non-empty, names the upstream networks (by their
+	// declared "name", not filename) to chain into, one emitted conflist
+	// each. When empty, the watcher falls back to chaining into the single
+	// lexicographically-first conf/conflist in confDir.
+	chainTargets []string
+
+	watcher *fsnotify.Watcher
+	stop    chan struct{}
+}
+
+// newCNIWatcher creates a watcher for confDir. cniConfChain is the raw
+// Cilium plugin stanza that gets inserted into whatever upstream conflist
+// is currently primary. chainTargets is optional; see cniWatcher.chainTargets.
+func newCNIWatcher(confDir, chainMode string, cniConfChain []byte, chainTargets []string) (*cniWatcher, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fsWatcher.Add(confDir); err != nil {
+		fsWatcher.Close()
+		return nil, err
+	}
+
+	return &cniWatcher{
+		confDir:      confDir,
+		chainMode:    chainMode,
+		cniConfChain: cniConfChain,
+		chainTargets: chainTargets,
+		watcher:      fsWatcher,
+		stop:         make(chan struct{}),
+	}, nil
+}
+
+// watch runs the event loop until stopWatching is called. It should be run in its
+// own goroutine.
+func (w *cniWatcher) watch() {
+	var debounce *time.Timer
+
+	resync := func() {
+		if err := w.resync(); err != nil {
+			log.WithError(err).Warn("Failed to re-install CNI configuration")
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			log.WithField("event", event).Debug("Detected CNI conf dir change")
+
+			if debounce == nil {
+				debounce = time.NewTimer(cniWatchDebounce)
+			} else {
+				if !debounce.Stop() {
+					<-debounce.C
+				}
+				debounce.Reset(cniWatchDebounce)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Warn("Error while watching CNI conf dir")
+		case <-func() <-chan time.Time {
+			if debounce == nil {
+				return nil
+			}
+			return debounce.C
+		}():
+			debounce = nil
+			resync()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// stopWatching stops the event loop and releases the underlying fsnotify
+// watcher.
+func (w *cniWatcher) stopWatching() {
+	close(w.stop)
+	w.watcher.Close()
+}
+
+// resync re-resolves the upstream conflist(s), re-chains the Cilium plugin
+// into each, and removes any previously chained file whose upstream
+// primary has since disappeared.
+func (w *cniWatcher) resync() error {
+	if len(w.chainTargets) > 0 {
+		return w.resyncTargets()
+	}
+
+	_, confList, err := getDefaultCNINetworkList(w.confDir)
+	if err != nil {
+		// No upstream primary is left to chain into, so every chained
+		// conflist this installer owns is stale.
+		if rmErr := w.removeStaleChainedConfs(""); rmErr != nil {
+			log.WithError(rmErr).Warn("Failed to remove stale chained CNI confs")
+		}
+		return err
+	}
+
+	newConfList, err := insertConfList(w.chainMode, confList, w.cniConfChain)
+	if err != nil {
+		return err
+	}
+
+	newConfList, err = markCNIConfAsOwned(newConfList)
+	if err != nil {
+		return err
+	}
+
+	name, err := cniConfigName(confList)
+	if err != nil {
+		return err
+	}
+
+	chainedPath, err := chainedConfPath(w.confDir, name)
+	if err != nil {
+		return err
+	}
+	if err := writeCNIConfIfChanged(chainedPath, newConfList, 0644); err != nil {
+		return err
+	}
+
+	return w.removeStaleChainedConfs(chainedPath)
+}
+
+// resyncTargets chains into every network named in w.chainTargets, emitting
+// one conflist per target. A target whose upstream network can't be found
+// in confDir is held back (no conflist is written for it, and one emitted
+// for it earlier is removed as stale) rather than silently falling through
+// to whatever the default primary happens to be.
+func (w *cniWatcher) resyncTargets() error {
+	networks, err := discoverCNINetworkLists(w.confDir)
+	if err != nil {
+		return err
+	}
+
+	keptPaths := make(map[string]struct{}, len(w.chainTargets))
+
+	for _, target := range w.chainTargets {
+		network, ok := networks[target]
+		if !ok {
+			log.WithField("target", target).Warn("Holding back CNI chain: named network not found")
+			continue
+		}
+
+		// Use w.chainMode, not target, for the chained conflist's "name"
+		// field: the operator-configured chain mode identifies the chained
+		// network the same way for every target, consistent with the
+		// single-target resync() path above. The target's own name is
+		// still what distinguishes the emitted files from one another
+		// (see chainedConfPath).
+		newConfList, err := insertConfList(w.chainMode, network.Bytes, w.cniConfChain)
+		if err != nil {
+			log.WithError(err).WithField("target", target).Warn("Failed to chain into named network")
+			continue
+		}
+
+		newConfList, err = markCNIConfAsOwned(newConfList)
+		if err != nil {
+			log.WithError(err).WithField("target", target).Warn("Failed to chain into named network")
+			continue
+		}
+
+		path, err := chainedConfPath(w.confDir, target)
+		if err != nil {
+			log.WithError(err).WithField("target", target).Warn("Refusing to chain into named network")
+			continue
+		}
+		if err := writeCNIConfIfChanged(path, newConfList, 0644); err != nil {
+			log.WithError(err).WithField("target", target).Warn("Failed to write chained conflist")
+			continue
+		}
+
+		keptPaths[path] = struct{}{}
+	}
+
+	return w.removeStaleMultiTargetChainedConfs(keptPaths)
+}
+
+// chainedConfPath is the deterministic filename this installer writes the
+// chained conflist for the network named name under. The fixed
+// "05-cilium-chain-" prefix guarantees it sorts ahead of the numbered
+// upstream filename conventions (e.g. "10-calico.conf"), so it's always the
+// file a CRI relying on lexicographic primary-selection picks up - and it
+// never collides with (or gets mistaken for) the original upstream file,
+// which this installer never renames or deletes.
+//
+// name comes straight from an upstream conflist's declared "name" field, so
+// it's rejected if it isn't safe to interpolate into a single path element;
+// otherwise a conflist with a crafted name could make the chained conflist
+// escape confDir.
+func chainedConfPath(confDir, name string) (string, error) {
+	if err := validateCNIConfName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(confDir, fmt.Sprintf("05-cilium-chain-%s.conflist", name)), nil
+}
+
+// validateCNIConfName reports an error if name isn't safe to use as a
+// single path element, e.g. because it contains a path separator or "..".
+func validateCNIConfName(name string) error {
+	if name == "" {
+		return fmt.Errorf("CNI network name is empty")
+	}
+	if name == "." || name == ".." || name != filepath.Base(name) {
+		return fmt.Errorf("CNI network name %q is not safe to use in a filename", name)
+	}
+	return nil
+}
+
+// removeStaleMultiTargetChainedConfs removes previously emitted per-target
+// chained conflists that this resync no longer produced, e.g. because the
+// target's upstream network disappeared.
+func (w *cniWatcher) removeStaleMultiTargetChainedConfs(keptPaths map[string]struct{}) error {
+	entries, err := os.ReadDir(w.confDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(w.confDir, entry.Name())
+		if _, kept := keptPaths[path]; kept {
+			continue
+		}
+		if !strings.HasPrefix(entry.Name(), "05-cilium-chain-") {
+			continue
+		}
+
+		owned, err := isOwnedCNIConf(path)
+		if err != nil || !owned {
+			continue
+		}
+
+		if err := removeOwnedCNIConf(path); err != nil {
+			log.WithError(err).WithField("file", path).Warn("Failed to remove stale chained CNI conf")
+			continue
+		}
+
+		log.WithField("file", path).Info("Removed stale chained CNI conf")
+	}
+
+	return nil
+}
+
+// removeStaleChainedConfs deletes chained conflists that this installer
+// owns other than keptPath, e.g. because the operator reordered or removed
+// the original file this resync chained into.
+func (w *cniWatcher) removeStaleChainedConfs(keptPath string) error {
+	entries, err := os.ReadDir(w.confDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(w.confDir, entry.Name())
+		if path == keptPath {
+			continue
+		}
+
+		owned, err := isOwnedCNIConf(path)
+		if err != nil || !owned {
+			continue
+		}
+
+		if err := removeOwnedCNIConf(path); err != nil {
+			log.WithError(err).WithField("file", path).Warn("Failed to remove stale chained CNI conf")
+			continue
+		}
+
+		log.WithField("file", path).Info("Removed stale chained CNI conf")
+	}
+
+	return nil
+}
+
+// removeOwnedCNIConf removes a chained conflist this installer owns.
+func removeOwnedCNIConf(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// GC removes chained conflists this installer owns whose upstream network
+// no longer exists, e.g. because the agent was down when an operator
+// deleted or renamed the original config. It's meant to run once at agent
+// startup, before the directory watcher takes over steady-state cleanup,
+// mirroring the boot-time GC pass CNI 0.8.1+ plugins run for stale
+// resources.
+func GC(confDir, chainMode string, cniConfChain []byte, chainTargets []string) error {
+	w := &cniWatcher{
+		confDir:      confDir,
+		chainMode:    chainMode,
+		cniConfChain: cniConfChain,
+		chainTargets: chainTargets,
+	}
+	return w.resync()
+}
+
+// StartCNIChainWatcher runs the boot-time GC pass and then starts the
+// long-running directory watcher that keeps the chained conflist(s) in sync
+// for the rest of the agent's lifetime, so that an admin re-ordering or
+// rotating CNI configs doesn't silently break chaining until the next agent
+// restart. This is the entrypoint the daemon's CNI install step should call
+// once cniConfChain has been built.
+func StartCNIChainWatcher(confDir, chainMode string, cniConfChain []byte, chainTargets []string) (*cniWatcher, error) {
+	if err := GC(confDir, chainMode, cniConfChain, chainTargets); err != nil {
+		log.WithError(err).Warn("Failed to garbage-collect stale CNI chain configuration")
+	}
+
+	w, err := newCNIWatcher(confDir, chainMode, cniConfChain, chainTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	go w.watch()
+
+	return w, nil
+}
+
+// writeCNIConfIfChanged writes data to path via atomicWrite, but only if the
+// file doesn't already hold those exact bytes. Every resync() and
+// resyncTargets() call rewrites the conflist(s) it owns unconditionally,
+// and atomicWrite's create/chmod/write/rename is itself an fsnotify event
+// in the watched directory; without this check a resync that changes
+// nothing still re-arms the watcher's debounce and triggers another
+// resync, forever. Skipping no-op writes breaks that loop.
+func writeCNIConfIfChanged(path string, data []byte, mode os.FileMode) error {
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	return atomicWrite(path, data, mode)
+}
+
+// markCNIConfAsOwned embeds the cni-chain-owner marker into the conflist so
+// that subsequent runs can recognize files this installer wrote.
+func markCNIConfAsOwned(confList []byte) ([]byte, error) {
+	var confMap map[string]interface{}
+	if err := json.Unmarshal(confList, &confMap); err != nil {
+		return nil, err
+	}
+
+	confMap[cniChainOwnerKey] = cniChainOwnerValue
+
+	return marshalCNIConfig(confMap)
+}
+
+// isOwnedCNIConf reports whether the conflist at path carries the
+// cni-chain-owner marker this installer writes, as opposed to a file an
+// operator authored by hand.
+func isOwnedCNIConf(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	var confMap map[string]interface{}
+	if err := json.Unmarshal(data, &confMap); err != nil {
+		// Not valid JSON; assume it's not ours and leave it alone.
+		return false, nil
+	}
+
+	owner, ok := confMap[cniChainOwnerKey]
+	return ok && owner == cniChainOwnerValue, nil
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarkAndIsOwnedCNIConf(t *testing.T) {
+	tempDir := t.TempDir()
+
+	owned, err := markCNIConfAsOwned([]byte(`{"name": "cilium-chain", "plugins": []}`))
+	require.NoError(t, err)
+
+	path := filepath.Join(tempDir, "05-cilium.conflist")
+	require.NoError(t, os.WriteFile(path, owned, 0o644))
+
+	isOwned, err := isOwnedCNIConf(path)
+	require.NoError(t, err)
+	require.True(t, isOwned)
+
+	unownedPath := filepath.Join(tempDir, "10-calico.conflist")
+	require.NoError(t, os.WriteFile(unownedPath, []byte(`{"name": "calico", "plugins": []}`), 0o644))
+
+	isOwned, err = isOwnedCNIConf(unownedPath)
+	require.NoError(t, err)
+	require.False(t, isOwned)
+}
+
+func TestChainedConfPath(t *testing.T) {
+	path, err := chainedConfPath("/etc/cni/net.d", "calico")
+	require.NoError(t, err)
+	require.Equal(t, "/etc/cni/net.d/05-cilium-chain-calico.conflist", path)
+}
+
+func TestChainedConfPathRejectsUnsafeNames(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../escape", "a/b", "/etc/passwd"} {
+		_, err := chainedConfPath("/etc/cni/net.d", name)
+		require.Errorf(t, err, "expected name %q to be rejected", name)
+	}
+}
+
+func TestRemoveStaleChainedConfs(t *testing.T) {
+	tempDir := t.TempDir()
+
+	owned, err := markCNIConfAsOwned([]byte(`{"name": "cilium-chain", "plugins": []}`))
+	require.NoError(t, err)
+
+	stalePath := filepath.Join(tempDir, "05-calico.conflist")
+	require.NoError(t, os.WriteFile(stalePath, owned, 0o644))
+
+	keptPath := filepath.Join(tempDir, "10-calico.conflist")
+	require.NoError(t, os.WriteFile(keptPath, owned, 0o644))
+
+	w := &cniWatcher{confDir: tempDir}
+	require.NoError(t, w.removeStaleChainedConfs(keptPath))
+
+	_, err = os.Stat(stalePath)
+	require.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(keptPath)
+	require.NoError(t, err)
+}
+
+func TestResyncDoesNotRechainOwnOutput(t *testing.T) {
+	tempDir := t.TempDir()
+
+	originalPath := filepath.Join(tempDir, "10-calico.conf")
+	require.NoError(t, os.WriteFile(originalPath, []byte(`
+{
+	"cniVersion": "0.3.1",
+	"name": "calico",
+	"type": "calico"
+}`), 0o644))
+
+	cniConfChain := []byte(`{"cniVersion": "0.3.1", "name": "cilium-cni", "type": "cilium-cni"}`)
+
+	w := &cniWatcher{
+		confDir:      tempDir,
+		chainMode:    "generic-veth",
+		cniConfChain: cniConfChain,
+	}
+	require.NoError(t, w.resync())
+	require.NoError(t, w.resync())
+
+	chainedPath, err := chainedConfPath(tempDir, "calico")
+	require.NoError(t, err)
+	chained, err := os.ReadFile(chainedPath)
+	require.NoError(t, err)
+	require.Contains(t, string(chained), "cilium-cni")
+
+	original, err := os.ReadFile(originalPath)
+	require.NoError(t, err)
+	require.NotContains(t, string(original), "cilium-cni")
+}
+
+// TestResyncSkipsNoopWrite verifies that a resync which would produce byte-
+// identical output to what's already on disk doesn't rewrite the file. The
+// watcher's own atomicWrite is itself an fsnotify event in confDir, so a
+// resync that always writes would re-arm the debounce and re-trigger
+// itself forever.
+func TestResyncSkipsNoopWrite(t *testing.T) {
+	tempDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "10-calico.conf"), []byte(`
+{
+	"cniVersion": "0.3.1",
+	"name": "calico",
+	"type": "calico"
+}`), 0o644))
+
+	cniConfChain := []byte(`{"cniVersion": "0.3.1", "name": "cilium-cni", "type": "cilium-cni"}`)
+
+	w := &cniWatcher{
+		confDir:      tempDir,
+		chainMode:    "generic-veth",
+		cniConfChain: cniConfChain,
+	}
+	require.NoError(t, w.resync())
+
+	chainedPath, err := chainedConfPath(tempDir, "calico")
+	require.NoError(t, err)
+	info, err := os.Stat(chainedPath)
+	require.NoError(t, err)
+	firstModTime := info.ModTime()
+
+	require.NoError(t, w.resync())
+
+	info, err = os.Stat(chainedPath)
+	require.NoError(t, err)
+	require.Equal(t, firstModTime, info.ModTime(), "resync rewrote identical output, which would re-arm the watcher's debounce")
+}
+
+func TestResyncTargetsHoldsBackMissingTarget(t *testing.T) {
+	tempDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "05-calico.conflist"), []byte(`
+{
+	"cniVersion": "0.3.1",
+	"name": "calico",
+	"plugins": [{"type": "calico"}]
+}`), 0o644))
+
+	cniConfChain := []byte(`{"cniVersion": "0.3.1", "name": "cilium-cni", "type": "cilium-cni"}`)
+
+	w := &cniWatcher{
+		confDir:      tempDir,
+		chainMode:    "generic-veth",
+		cniConfChain: cniConfChain,
+		chainTargets: []string{"calico", "macvlan-net"},
+	}
+	require.NoError(t, w.resyncTargets())
+
+	calicoPath, err := chainedConfPath(tempDir, "calico")
+	require.NoError(t, err)
+	chained, err := os.ReadFile(calicoPath)
+	require.NoError(t, err)
+	require.Contains(t, string(chained), `"name": "generic-veth"`)
+
+	macvlanPath, err := chainedConfPath(tempDir, "macvlan-net")
+	require.NoError(t, err)
+	_, err = os.Stat(macvlanPath)
+	require.True(t, os.IsNotExist(err))
+}
+
+// TestStartCNIChainWatcherRunsBootTimeGC verifies that StartCNIChainWatcher
+// performs an initial GC pass synchronously, before the watcher goroutine
+// takes over steady-state cleanup, so a stale owned conflist left behind by
+// a prior run doesn't linger until the next fs event.
+func TestStartCNIChainWatcherRunsBootTimeGC(t *testing.T) {
+	tempDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "05-calico.conflist"), []byte(`
+{
+	"cniVersion": "0.3.1",
+	"name": "calico",
+	"plugins": [{"type": "calico"}]
+}`), 0o644))
+
+	owned, err := markCNIConfAsOwned([]byte(`{"name": "generic-veth", "plugins": []}`))
+	require.NoError(t, err)
+	stalePath := filepath.Join(tempDir, "05-cilium-chain-stale-target.conflist")
+	require.NoError(t, os.WriteFile(stalePath, owned, 0o644))
+
+	cniConfChain := []byte(`{"cniVersion": "0.3.1", "name": "cilium-cni", "type": "cilium-cni"}`)
+
+	w, err := StartCNIChainWatcher(tempDir, "generic-veth", cniConfChain, []string{"calico"})
+	require.NoError(t, err)
+	defer w.stopWatching()
+
+	_, err = os.Stat(stalePath)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package worldcidrsmap
+
+import (
+	"net"
+	"unsafe"
+
+	"github.com/cilium/cilium/pkg/bpf"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+)
+
+const (
+	// MapName6 is the name of the IPv6 world CIDRs BPF map.
+	MapName6 = "cilium_world_cidrs_v6"
+
+	// MaxEntries6 mirrors the v4 map's capacity; IPv6 world CIDR sets are
+	// expected at similar scale.
+	MaxEntries6 = 1 << 16
+)
+
+var log6 = logging.DefaultLogger.WithField(logfields.LogSubsys, "worldcidrsmap")
+
+// WorldCIDRKey6 is the IPv6 sibling of WorldCIDRKey4: an LPM trie key of a
+// prefix length followed by the full 128-bit address masked to it.
+type WorldCIDRKey6 struct {
+	Prefixlen uint32
+	Addr      [16]byte
+}
+
+func (k *WorldCIDRKey6) String() string             { return k.GetCIDR().String() }
+func (k *WorldCIDRKey6) GetKeyPtr() unsafe.Pointer  { return unsafe.Pointer(k) }
+func (k *WorldCIDRKey6) NewValue() bpf.MapValue     { return &WorldCIDRVal{} }
+func (k *WorldCIDRKey6) DeepCopyMapKey() bpf.MapKey { return &WorldCIDRKey6{k.Prefixlen, k.Addr} }
+
+// NewWorldCIDRKey6 builds the IPv6 world CIDR map key for cidr.
+func NewWorldCIDRKey6(cidr *net.IPNet) WorldCIDRKey6 {
+	ones, _ := cidr.Mask.Size()
+
+	var addr [16]byte
+	copy(addr[:], cidr.IP.To16())
+
+	return WorldCIDRKey6{Prefixlen: uint32(ones), Addr: addr}
+}
+
+// GetCIDR returns the net.IPNet this key represents.
+func (k *WorldCIDRKey6) GetCIDR() *net.IPNet {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, k.Addr[:])
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(int(k.Prefixlen), 128)}
+}
+
+// Matches reports whether cidr maps to exactly this key (same address and
+// prefix length); a narrower cidr inside this key's prefix does not match.
+func (k *WorldCIDRKey6) Matches(cidr *net.IPNet) bool {
+	return *k == NewWorldCIDRKey6(cidr)
+}
+
+// worldCIDRsMap6 wraps the IPv6 world CIDRs BPF map.
+type worldCIDRsMap6 struct {
+	*bpf.Map
+}
+
+// WorldCIDRsMap6 is the IPv6 sibling of WorldCIDRsMap: an LPM trie keyed on
+// the full 128-bit prefix. Callers must gate its use on
+// probe.HaveFullLPMv6, since not every kernel can traverse a 128-bit-keyed
+// LPM trie correctly.
+var WorldCIDRsMap6 = newWorldCIDRsMap6()
+
+func newWorldCIDRsMap6() *worldCIDRsMap6 {
+	return &worldCIDRsMap6{
+		Map: bpf.NewMap(MapName6, bpf.MapTypeLPMTrie,
+			&WorldCIDRKey6{}, int(unsafe.Sizeof(WorldCIDRKey6{})),
+			&WorldCIDRVal{}, int(unsafe.Sizeof(WorldCIDRVal{})),
+			MaxEntries6, bpf.BPF_F_NO_PREALLOC, 0, bpf.ConvertKeyValue).WithCache(),
+	}
+}
+
+// Add inserts cidr into the map.
+func (m *worldCIDRsMap6) Add(cidr *net.IPNet) error {
+	key := NewWorldCIDRKey6(cidr)
+	return m.Update(&key, &WorldCIDRVal{})
+}
+
+// Delete removes cidr from the map.
+func (m *worldCIDRsMap6) Delete(cidr *net.IPNet) error {
+	key := NewWorldCIDRKey6(cidr)
+	return m.Map.Delete(&key)
+}
+
+// IterateWithCallback iterates through all the keys/values of the map,
+// passing each to cb. It's the v6 sibling of WorldCIDRsMap's
+// IterateWithCallback.
+func (m *worldCIDRsMap6) IterateWithCallback(cb func(key *WorldCIDRKey6, val *WorldCIDRVal)) {
+	err := m.Map.DumpReliablyWithCallback(func(key bpf.MapKey, value bpf.MapValue) {
+		cb(key.(*WorldCIDRKey6), value.(*WorldCIDRVal))
+	}, nil)
+	if err != nil {
+		log6.WithError(err).Error("Error dumping IPv6 world CIDRs map")
+	}
+}
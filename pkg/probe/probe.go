@@ -28,10 +28,20 @@ type probeValue struct {
 	Value uint32
 }
 
+// probeKey6 is the 128-bit-prefix analog of probeKey, used to confirm the
+// kernel can traverse an LPM trie keyed on a full IPv6 address.
+type probeKey6 struct {
+	Prefixlen uint32
+	Key       [16]byte
+}
+
 var (
 	haveFullLPMOnce sync.Once
 	haveFullLPM     bool
 
+	haveFullLPMv6Once sync.Once
+	haveFullLPMv6     bool
+
 	log = logging.DefaultLogger.WithField(logfields.LogSubsys, "probe")
 )
 
@@ -44,6 +54,11 @@ func (p *probeValue) String() string                 { return fmt.Sprintf("value
 func (p *probeValue) GetValuePtr() unsafe.Pointer    { return unsafe.Pointer(p) }
 func (p *probeValue) DeepCopyMapValue() bpf.MapValue { return &probeValue{p.Value} }
 
+func (p *probeKey6) String() string             { return fmt.Sprintf("key=%v", p.Key) }
+func (p *probeKey6) GetKeyPtr() unsafe.Pointer  { return unsafe.Pointer(p) }
+func (p *probeKey6) NewValue() bpf.MapValue     { return &probeValue{} }
+func (p *probeKey6) DeepCopyMapKey() bpf.MapKey { return &probeKey6{p.Prefixlen, p.Key} }
+
 // HaveFullLPM tests whether kernel supports fully functioning BPF LPM map
 // with proper bpf.GetNextKey() traversal. Needs 4.16 or higher.
 func HaveFullLPM() bool {
@@ -73,6 +88,38 @@ func HaveFullLPM() bool {
 	return haveFullLPM
 }
 
+// HaveFullLPMv6 tests whether the kernel supports a fully functioning BPF
+// LPM map keyed on a 128-bit (IPv6) prefix, with proper bpf.GetNextKey()
+// traversal. Callers should gate any v6 LPM-backed datapath (e.g. a v6
+// world CIDRs map) on this before enabling it, since a kernel can support
+// HaveFullLPM's 32-bit key while mishandling the wider 128-bit one.
+func HaveFullLPMv6() bool {
+	haveFullLPMv6Once.Do(func() {
+		m := bpf.NewMap("cilium_test6", bpf.MapTypeLPMTrie,
+			&probeKey6{}, int(unsafe.Sizeof(probeKey6{})),
+			&probeValue{}, int(unsafe.Sizeof(probeValue{})),
+			1, bpf.BPF_F_NO_PREALLOC, 0, bpf.ConvertKeyValue).WithCache()
+		err := m.CreateUnpinned()
+		defer m.Close()
+		if err != nil {
+			return
+		}
+		err = bpf.UpdateElement(m.GetFd(), m.Name(), unsafe.Pointer(&probeKey6{}),
+			unsafe.Pointer(&probeValue{}), bpf.BPF_ANY)
+		if err != nil {
+			return
+		}
+		err = bpf.GetNextKey(m.GetFd(), nil, unsafe.Pointer(&probeKey6{}))
+		if err != nil {
+			return
+		}
+
+		haveFullLPMv6 = true
+	})
+
+	return haveFullLPMv6
+}
+
 // HaveIPv6Support tests whether kernel can open an IPv6 socket. This will
 // also implicitly auto-load IPv6 kernel module if available and not yet
 // loaded.
@@ -14,16 +14,38 @@ import (
 	"github.com/cilium/cilium/pkg/logging"
 	"github.com/cilium/cilium/pkg/logging/logfields"
 	"github.com/cilium/cilium/pkg/maps/worldcidrsmap"
+	"github.com/cilium/cilium/pkg/probe"
 )
 
 var (
 	log = logging.DefaultLogger.WithField(logfields.LogSubsys, "worldcidrs")
 )
 
+// driftCheckInterval is how often the manager falls back to a full BPF-map
+// scan to correct any drift the incremental event-diffed path missed, e.g.
+// entries changed by something other than this manager.
+const driftCheckInterval = 5 * time.Minute
+
 type k8sCacheSyncedChecker interface {
 	K8sCacheIsSynced() bool
 }
 
+// worldCIDRsMapV4 and worldCIDRsMapV6 are satisfied by
+// worldcidrsmap.WorldCIDRsMap and worldcidrsmap.WorldCIDRsMap6
+// respectively. Abstracting them lets tests exercise the manager's
+// reconciliation logic against a fake map instead of a real BPF map.
+type worldCIDRsMapV4 interface {
+	Add(cidr *net.IPNet) error
+	Delete(cidr *net.IPNet) error
+	IterateWithCallback(cb func(key *worldcidrsmap.WorldCIDRKey4, val *worldcidrsmap.WorldCIDRVal))
+}
+
+type worldCIDRsMapV6 interface {
+	Add(cidr *net.IPNet) error
+	Delete(cidr *net.IPNet) error
+	IterateWithCallback(cb func(key *worldcidrsmap.WorldCIDRKey6, val *worldcidrsmap.WorldCIDRVal))
+}
+
 // cidrSetID includes CIDR set name and namespace.
 type cidrSetID = types.NamespacedName
 
@@ -32,7 +54,34 @@ type CIDRSet struct {
 	// id is the parsed config name and namespace
 	id cidrSetID
 
-	cidrs []*net.IPNet
+	// cidrsV4 and cidrsV6 hold the set's CIDRs, split by address family at
+	// parse time so the manager can reconcile each into its own BPF map.
+	cidrsV4 []*net.IPNet
+	cidrsV6 []*net.IPNet
+}
+
+// NewCIDRSet builds a CIDRSet for id, splitting cidrs into their v4/v6
+// buckets. IPv6 CIDRs are silently dropped if the kernel doesn't support a
+// full 128-bit-keyed LPM trie traversal, since they could never be
+// reconciled into the BPF map correctly.
+func NewCIDRSet(id cidrSetID, cidrs []*net.IPNet) CIDRSet {
+	set := CIDRSet{id: id}
+
+	haveFullLPMv6 := probe.HaveFullLPMv6()
+	for _, cidr := range cidrs {
+		if cidr.IP.To4() != nil {
+			set.cidrsV4 = append(set.cidrsV4, cidr)
+			continue
+		}
+
+		if !haveFullLPMv6 {
+			log.WithField(logfields.CIDR, cidr).Warn("Ignoring IPv6 world CIDR: kernel lacks full IPv6 LPM support")
+			continue
+		}
+		set.cidrsV6 = append(set.cidrsV6, cidr)
+	}
+
+	return set
 }
 
 // The world CIDRs manager stores the internal data tracking the world CIDRs.
@@ -44,18 +93,39 @@ type Manager struct {
 	// cache with the k8s API server
 	k8sCacheSyncedChecker k8sCacheSyncedChecker
 
+	// mapV4 and mapV6 are the BPF world CIDR maps this manager reconciles
+	// into. They default to worldcidrsmap.WorldCIDRsMap/WorldCIDRsMap6;
+	// tests substitute a fake.
+	mapV4 worldCIDRsMapV4
+	mapV6 worldCIDRsMapV6
+
 	// cidrSets stores CIDR sets indexed by their ID
 	cidrSets map[cidrSetID]*CIDRSet
+
+	// appliedV4 and appliedV6 hold the desired state as of the last time it
+	// was applied to the BPF maps (either via an event diff or a full
+	// scan), so the next reconcile only needs to apply what changed.
+	appliedV4 map[worldcidrsmap.WorldCIDRKey4]struct{}
+	appliedV6 map[worldcidrsmap.WorldCIDRKey6]struct{}
+
+	// haveSyncedOnce tracks whether the startup full scan has run yet; it
+	// gates whether reconcile() can use the incremental diff path.
+	haveSyncedOnce bool
 }
 
 // NewWorldCIDRsManager returns a new world CIDRs manager.
 func NewWorldCIDRsManager(k8sCacheSyncedChecker k8sCacheSyncedChecker) *Manager {
 	manager := &Manager{
 		k8sCacheSyncedChecker: k8sCacheSyncedChecker,
+		mapV4:                 worldcidrsmap.WorldCIDRsMap,
+		mapV6:                 worldcidrsmap.WorldCIDRsMap6,
 		cidrSets:              make(map[cidrSetID]*CIDRSet),
+		appliedV4:             make(map[worldcidrsmap.WorldCIDRKey4]struct{}),
+		appliedV6:             make(map[worldcidrsmap.WorldCIDRKey6]struct{}),
 	}
 
 	manager.runReconciliationAfterK8sSync()
+	manager.runPeriodicDriftCheck()
 
 	return manager
 }
@@ -78,10 +148,40 @@ func (manager *Manager) runReconciliationAfterK8sSync() {
 	}()
 }
 
+// runPeriodicDriftCheck spawns a goroutine that forces a full BPF-map scan
+// every driftCheckInterval, to correct any drift the incremental
+// event-diffed reconciliation path wouldn't otherwise notice.
+func (manager *Manager) runPeriodicDriftCheck() {
+	go func() {
+		ticker := time.NewTicker(driftCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			manager.ForceResync()
+		}
+	}()
+}
+
+// ForceResync runs a full BPF-map scan and corrects any drift against the
+// manager's desired state, bypassing the incremental event-diffed path.
+// It's meant for the periodic drift-check timer and for callers (e.g. the
+// k8s-sync goroutine) that need to be sure the maps are authoritative.
+func (manager *Manager) ForceResync() {
+	manager.Lock()
+	defer manager.Unlock()
+
+	if !manager.k8sCacheSyncedChecker.K8sCacheIsSynced() {
+		return
+	}
+
+	manager.fullSync()
+}
+
 // Event handlers
 
-// OnAddWorldCIDRSet parses the given CIDR set and updates internal state
-// with the CIDRs.
+// OnAddWorldCIDRSet updates internal state with the given CIDR set, built
+// via NewCIDRSet. Mixed-family sets (both v4 and v6 CIDRs) are accepted;
+// each family is reconciled into its own BPF map.
 func (manager *Manager) OnAddWorldCIDRSet(cidrSet CIDRSet) {
 	manager.Lock()
 	defer manager.Unlock()
@@ -118,83 +218,254 @@ func (manager *Manager) OnDeleteWorldCIDRSet(id cidrSetID) {
 	manager.reconcile()
 }
 
-func (manager *Manager) addMissingCIDRs() {
-	worldCIDRs := map[worldcidrsmap.WorldCIDRKey4]worldcidrsmap.WorldCIDRVal{}
-	worldcidrsmap.WorldCIDRsMap.IterateWithCallback(
-		func(key *worldcidrsmap.WorldCIDRKey4, val *worldcidrsmap.WorldCIDRVal) {
-			worldCIDRs[*key] = *val
-		})
+// desiredV4 and desiredV6 build the manager's desired state from cidrSets,
+// keyed the same way the BPF maps are, so it can be diffed directly against
+// either the last-applied set or a full map scan.
+func (manager *Manager) desiredV4() map[worldcidrsmap.WorldCIDRKey4]*net.IPNet {
+	desired := map[worldcidrsmap.WorldCIDRKey4]*net.IPNet{}
+	for _, cidrSet := range manager.cidrSets {
+		for _, cidr := range cidrSet.cidrsV4 {
+			desired[worldcidrsmap.NewWorldCIDRKey4(cidr)] = cidr
+		}
+	}
+	return desired
+}
 
-	addCIDR := func(cidr *net.IPNet) {
-		worldCIDRKey := worldcidrsmap.NewWorldCIDRKey4(cidr)
-		_, cidrPresent := worldCIDRs[worldCIDRKey]
+func (manager *Manager) desiredV6() map[worldcidrsmap.WorldCIDRKey6]*net.IPNet {
+	desired := map[worldcidrsmap.WorldCIDRKey6]*net.IPNet{}
+	for _, cidrSet := range manager.cidrSets {
+		for _, cidr := range cidrSet.cidrsV6 {
+			desired[worldcidrsmap.NewWorldCIDRKey6(cidr)] = cidr
+		}
+	}
+	return desired
+}
 
-		if cidrPresent {
-			return
+// reconcile reconciles the manager's desired state with the BPF world CIDR
+// maps by diffing it against the last-applied state and only touching what
+// changed. It never scans the BPF maps itself; that only happens on
+// startup and on the periodic drift-check timer (see fullSync).
+//
+// Whenever it encounters an error, it will just log it and move to the next
+// item, in order to reconcile as many states as possible.
+func (manager *Manager) reconcile() {
+	if !manager.k8sCacheSyncedChecker.K8sCacheIsSynced() {
+		return
+	}
+
+	if !manager.haveSyncedOnce {
+		manager.fullSync()
+		return
+	}
+
+	manager.reconcileV4()
+	manager.reconcileV6()
+}
+
+func (manager *Manager) reconcileV4() {
+	desired := manager.desiredV4()
+
+	// Track what's actually applied starting from the previous state, not
+	// the desired state: a failed Add/Delete below must leave its key out
+	// of (or in) appliedV4 so the next reconcile retries it, rather than
+	// getting recorded as done and silently dropped until the next
+	// ForceResync drift-correction pass papers over it.
+	applied := copyKeySetV4(manager.appliedV4)
+
+	// The order matters here, as by first adding missing CIDRs and only
+	// then removing obsolete ones we make sure there will be no
+	// connectivity disruption.
+	for key, cidr := range desired {
+		if _, ok := manager.appliedV4[key]; ok {
+			continue
 		}
 
-		logger := log.WithFields(logrus.Fields{
-			logfields.CIDR: cidr,
-		})
+		logger := log.WithFields(logrus.Fields{logfields.CIDR: cidr})
+		if err := manager.mapV4.Add(cidr); err != nil {
+			logger.WithError(err).Error("Error adding world CIDR")
+			continue
+		}
+		applied[key] = struct{}{}
+		logger.Info("World CIDR added")
+		reconcileAddsTotal.WithLabelValues("v4").Inc()
+	}
+
+	for key := range manager.appliedV4 {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+
+		logger := log.WithFields(logrus.Fields{logfields.CIDR: key.GetCIDR()})
+		if err := manager.mapV4.Delete(key.GetCIDR()); err != nil {
+			logger.WithError(err).Error("Error removing world CIDR")
+			continue
+		}
+		delete(applied, key)
+		logger.Info("World CIDR removed")
+		reconcileDeletesTotal.WithLabelValues("v4").Inc()
+	}
+
+	manager.appliedV4 = applied
+}
+
+func (manager *Manager) reconcileV6() {
+	desired := manager.desiredV6()
+
+	// See reconcileV4 for why this starts from the previous state rather
+	// than the desired state.
+	applied := copyKeySetV6(manager.appliedV6)
+
+	for key, cidr := range desired {
+		if _, ok := manager.appliedV6[key]; ok {
+			continue
+		}
 
-		if err := worldcidrsmap.WorldCIDRsMap.Add(cidr); err != nil {
+		logger := log.WithFields(logrus.Fields{logfields.CIDR: cidr})
+		if err := manager.mapV6.Add(cidr); err != nil {
 			logger.WithError(err).Error("Error adding world CIDR")
-		} else {
-			logger.Info("World CIDR added")
+			continue
 		}
+		applied[key] = struct{}{}
+		logger.Info("World CIDR added")
+		reconcileAddsTotal.WithLabelValues("v6").Inc()
 	}
 
-	for _, cidrSet := range manager.cidrSets {
-		for _, cidr := range cidrSet.cidrs {
-			addCIDR(cidr)
+	for key := range manager.appliedV6 {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+
+		logger := log.WithFields(logrus.Fields{logfields.CIDR: key.GetCIDR()})
+		if err := manager.mapV6.Delete(key.GetCIDR()); err != nil {
+			logger.WithError(err).Error("Error removing world CIDR")
+			continue
 		}
+		delete(applied, key)
+		logger.Info("World CIDR removed")
+		reconcileDeletesTotal.WithLabelValues("v6").Inc()
 	}
+
+	manager.appliedV6 = applied
+}
+
+// fullSync dumps the BPF maps and corrects any drift against the manager's
+// desired state. It's the only path allowed to call IterateWithCallback, to
+// keep steady-state reconciliation at O(changes) rather than
+// O(sets × cidrs × mapEntries).
+func (manager *Manager) fullSync() {
+	manager.fullSyncV4()
+	manager.fullSyncV6()
+	manager.haveSyncedOnce = true
 }
 
-// removeUnusedCIDRs is responsible for removing any entry in the world CIDR
-// BPF map which is not baked by an actual k8s CiliumWorldCIDRSet.
-func (manager *Manager) removeUnusedCIDRs() {
-	worldCIDRs := map[worldcidrsmap.WorldCIDRKey4]worldcidrsmap.WorldCIDRVal{}
-	worldcidrsmap.WorldCIDRsMap.IterateWithCallback(
+func (manager *Manager) fullSyncV4() {
+	actual := map[worldcidrsmap.WorldCIDRKey4]struct{}{}
+	manager.mapV4.IterateWithCallback(
 		func(key *worldcidrsmap.WorldCIDRKey4, val *worldcidrsmap.WorldCIDRVal) {
-			worldCIDRs[*key] = *val
+			actual[*key] = struct{}{}
 		})
 
-nextCIDR:
-	for worldCIDR := range worldCIDRs {
-		for _, cidrSet := range manager.cidrSets {
-			for _, cidr := range cidrSet.cidrs {
-				if worldCIDR.Matches(cidr) {
-					continue nextCIDR
-				}
-			}
+	desired := manager.desiredV4()
+
+	// Track what's actually applied starting from what the scan found in
+	// the map, not the desired state: a failed Add/Delete below must leave
+	// its key out of (or in) appliedV4, the same as reconcileV4.
+	applied := copyKeySetV4(actual)
+
+	for key, cidr := range desired {
+		if _, ok := actual[key]; ok {
+			continue
 		}
 
-		logger := log.WithFields(logrus.Fields{
-			logfields.CIDR: worldCIDR.GetCIDR(),
+		logger := log.WithFields(logrus.Fields{logfields.CIDR: cidr})
+		if err := manager.mapV4.Add(cidr); err != nil {
+			logger.WithError(err).Error("Error adding world CIDR")
+			continue
+		}
+		applied[key] = struct{}{}
+		logger.Info("World CIDR added (drift correction)")
+		reconcileDriftCorrectionsTotal.WithLabelValues("v4").Inc()
+	}
+
+	for key := range actual {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+
+		logger := log.WithFields(logrus.Fields{logfields.CIDR: key.GetCIDR()})
+		if err := manager.mapV4.Delete(key.GetCIDR()); err != nil {
+			logger.WithError(err).Error("Error removing world CIDR")
+			continue
+		}
+		delete(applied, key)
+		logger.Info("World CIDR removed (drift correction)")
+		reconcileDriftCorrectionsTotal.WithLabelValues("v4").Inc()
+	}
+
+	manager.appliedV4 = applied
+}
+
+func (manager *Manager) fullSyncV6() {
+	actual := map[worldcidrsmap.WorldCIDRKey6]struct{}{}
+	manager.mapV6.IterateWithCallback(
+		func(key *worldcidrsmap.WorldCIDRKey6, val *worldcidrsmap.WorldCIDRVal) {
+			actual[*key] = struct{}{}
 		})
 
-		if err := worldcidrsmap.WorldCIDRsMap.Delete(worldCIDR.GetCIDR()); err != nil {
+	desired := manager.desiredV6()
+
+	// See fullSyncV4 for why this starts from actual rather than desired.
+	applied := copyKeySetV6(actual)
+
+	for key, cidr := range desired {
+		if _, ok := actual[key]; ok {
+			continue
+		}
+
+		logger := log.WithFields(logrus.Fields{logfields.CIDR: cidr})
+		if err := manager.mapV6.Add(cidr); err != nil {
+			logger.WithError(err).Error("Error adding world CIDR")
+			continue
+		}
+		applied[key] = struct{}{}
+		logger.Info("World CIDR added (drift correction)")
+		reconcileDriftCorrectionsTotal.WithLabelValues("v6").Inc()
+	}
+
+	for key := range actual {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+
+		logger := log.WithFields(logrus.Fields{logfields.CIDR: key.GetCIDR()})
+		if err := manager.mapV6.Delete(key.GetCIDR()); err != nil {
 			logger.WithError(err).Error("Error removing world CIDR")
-		} else {
-			logger.Info("World CIDR removed")
+			continue
 		}
+		delete(applied, key)
+		logger.Info("World CIDR removed (drift correction)")
+		reconcileDriftCorrectionsTotal.WithLabelValues("v6").Inc()
 	}
+
+	manager.appliedV6 = applied
 }
 
-// reconcile is responsible for reconciling the state of the manager (i.e. the
-// desired state) with the actual state of the node (world CIDR map entries).
-//
-// Whenever it encounters an error, it will just log it and move to the next
-// item, in order to reconcile as many states as possible.
-func (manager *Manager) reconcile() {
-	if !manager.k8sCacheSyncedChecker.K8sCacheIsSynced() {
-		return
+// copyKeySetV4 and copyKeySetV6 return a shallow copy of a key set, so
+// callers can mutate the copy (as reconcileV4/fullSyncV4 and their V6
+// counterparts do, to record only what actually succeeded) without
+// disturbing the map the copy was taken from.
+func copyKeySetV4(orig map[worldcidrsmap.WorldCIDRKey4]struct{}) map[worldcidrsmap.WorldCIDRKey4]struct{} {
+	keys := make(map[worldcidrsmap.WorldCIDRKey4]struct{}, len(orig))
+	for key := range orig {
+		keys[key] = struct{}{}
 	}
+	return keys
+}
 
-	// The order of the next 2 function calls matters, as by first adding
-	// missing CIDRs and only then removing obsolete ones we make sure there
-	// will be no connectivity disruption.
-	manager.addMissingCIDRs()
-	manager.removeUnusedCIDRs()
+func copyKeySetV6(orig map[worldcidrsmap.WorldCIDRKey6]struct{}) map[worldcidrsmap.WorldCIDRKey6]struct{} {
+	keys := make(map[worldcidrsmap.WorldCIDRKey6]struct{}, len(orig))
+	for key := range orig {
+		keys[key] = struct{}{}
+	}
+	return keys
 }
@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package worldcidrs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "cilium"
+
+var (
+	// reconcileAddsTotal counts world CIDR BPF map entries added by the
+	// manager's incremental event-diffed path, split by address family;
+	// entries added by a full scan are counted in
+	// reconcileDriftCorrectionsTotal instead.
+	reconcileAddsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "worldcidrs",
+		Name:      "reconcile_adds_total",
+		Help:      "Number of world CIDR BPF map entries added during reconciliation",
+	}, []string{"family"})
+
+	// reconcileDeletesTotal counts world CIDR BPF map entries removed by
+	// the manager.
+	reconcileDeletesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "worldcidrs",
+		Name:      "reconcile_deletes_total",
+		Help:      "Number of world CIDR BPF map entries deleted during reconciliation",
+	}, []string{"family"})
+
+	// reconcileDriftCorrectionsTotal counts entries that a full BPF-map
+	// scan found out of sync with the in-memory desired state, i.e. that
+	// the incremental event-diffed path alone did not catch.
+	reconcileDriftCorrectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "worldcidrs",
+		Name:      "reconcile_drift_corrections_total",
+		Help:      "Number of world CIDR BPF map entries corrected by a drift-check scan",
+	}, []string{"family"})
+)